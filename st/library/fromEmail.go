@@ -1,11 +1,27 @@
 package library
 
 import (
+	"bytes"
+	"container/list"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"code.google.com/p/go-imap/go1/imap"
+	"github.com/emersion/go-imap"
+	idle "github.com/emersion/go-imap-idle"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-sasl"
+	"github.com/jhillyerd/enmime"
+	"golang.org/x/oauth2"
 
 	"github.com/nytlabs/streamtools/st/blocks"
 	"github.com/nytlabs/streamtools/st/util"
@@ -25,32 +41,215 @@ type FromEmail struct {
 	password string
 	mailbox  string
 
-	client *imap.Client
+	// authMethod selects how we authenticate against the IMAP server: either
+	// "plain" (the default, a regular Login) or "xoauth2" for providers like
+	// Gmail and Office365 that have dropped plain password auth.
+	authMethod   string
+	clientID     string
+	clientSecret string
+	tokenURL     string
+	refreshToken string
+
+	// includeAttachments controls whether attachment content is base64
+	// encoded and included in emitted messages. It defaults to false since
+	// attachment payloads can be large and most pipelines only care about
+	// the message headers and body.
+	includeAttachments bool
+
+	// searchFilter is a raw IMAP SEARCH criteria string (e.g. `UNSEEN SINCE
+	// 01-Jan-2024 FROM "alerts@example.com"`) scoping which messages fetchUnread
+	// considers. It defaults to "UNSEEN", so each poll only picks up new mail
+	// instead of re-fetching the whole mailbox. searchFields is the parsed
+	// form used on every search.
+	searchFilter string
+	searchFields []imap.Field
+
+	// markSeen causes fetchUnread to flag a message \Seen once it has been
+	// emitted, so the same mail isn't re-emitted on every poll.
+	markSeen bool
+
+	// threadMode is "none" (default) or "gmail". In "gmail" mode, messages
+	// are fetched with their X-GM-THRID/X-GM-MSGID attributes and grouped
+	// under a ThreadID field, tracked by threads. emitThreadSummaries gates
+	// whether a "thread-summary" event is also emitted on out as a thread is
+	// updated.
+	threadMode          string
+	emitThreadSummaries bool
+	maxThreads          int
+	threads             *threadTracker
+
+	// clientMu guards client, which is read by the idler goroutine and
+	// swapped out on every reconnect.
+	clientMu sync.Mutex
+	client   *client.Client
+
+	idler *idler
 }
 
+// fetchedMessage pairs a parsed email with the UID it was fetched under, so
+// callers can mark it \Seen after it has been emitted, and the Gmail thread
+// ID it belongs to, if any.
+type fetchedMessage struct {
+	uid      uint32
+	threadID string
+	email    emailMessage
+}
+
+// attachment is a single file pulled out of a parsed MIME message.
+type attachment struct {
+	Filename    string `json:"Filename"`
+	ContentType string `json:"ContentType"`
+	Size        int    `json:"Size"`
+	Content     string `json:"Content"`
+}
+
+// emailMessage is the structured representation of a fetched email, parsed
+// out of its raw RFC822 body so that downstream filter/mapper blocks can work
+// with it directly.
 type emailMessage struct {
-	Received time.Time `json:"timestamp"`
-	Body     string    `json:"email"`
+	Received    time.Time    `json:"timestamp"`
+	From        string       `json:"From"`
+	To          []string     `json:"To"`
+	Cc          []string     `json:"Cc"`
+	Subject     string       `json:"Subject"`
+	Date        time.Time    `json:"Date"`
+	MessageID   string       `json:"MessageID"`
+	InReplyTo   string       `json:"InReplyTo"`
+	References  []string     `json:"References"`
+	TextBody    string       `json:"TextBody"`
+	HTMLBody    string       `json:"HTMLBody"`
+	Attachments []attachment `json:"Attachments"`
+	ThreadID    string       `json:"ThreadID,omitempty"`
+}
+
+// threadSummary aggregates the messages seen so far in a single Gmail
+// thread.
+type threadSummary struct {
+	ThreadID     string    `json:"ThreadID"`
+	MessageCount int       `json:"MessageCount"`
+	Participants []string  `json:"Participants"`
+	FirstSeen    time.Time `json:"FirstSeen"`
+	LastSeen     time.Time `json:"LastSeen"`
+}
+
+// threadSummaryEvent is what gets emitted on out when EmitThreadSummaries is
+// set; "Event" lets downstream blocks tell it apart from an emailMessage.
+type threadSummaryEvent struct {
+	Event        string    `json:"Event"`
+	ThreadID     string    `json:"ThreadID"`
+	MessageCount int       `json:"MessageCount"`
+	Participants []string  `json:"Participants"`
+	FirstSeen    time.Time `json:"FirstSeen"`
+	LastSeen     time.Time `json:"LastSeen"`
+}
+
+// threadEntry is the mutable per-thread state tracked by threadTracker.
+// firstSeen reflects the first message this process observed in the
+// thread, not necessarily the thread's true earliest message, since the
+// tracker holds no state across restarts.
+type threadEntry struct {
+	id           string
+	messageCount int
+	participants map[string]struct{}
+	firstSeen    time.Time
+	lastSeen     time.Time
+}
+
+func (e *threadEntry) summary() threadSummary {
+	participants := make([]string, 0, len(e.participants))
+	for p := range e.participants {
+		participants = append(participants, p)
+	}
+	sort.Strings(participants)
+
+	return threadSummary{
+		ThreadID:     e.id,
+		MessageCount: e.messageCount,
+		Participants: participants,
+		FirstSeen:    e.firstSeen,
+		LastSeen:     e.lastSeen,
+	}
+}
+
+// threadTracker keeps rolling per-thread stats for Gmail thread mode,
+// bounded by an LRU of max entries so a long-running block doesn't grow
+// unbounded memory over a mailbox with many threads.
+type threadTracker struct {
+	max   int
+	order *list.List
+	index map[string]*list.Element
+}
+
+func newThreadTracker(max int) *threadTracker {
+	return &threadTracker{max: max, order: list.New(), index: make(map[string]*list.Element)}
+}
+
+// observe records a message seen in thread id, involving participants
+// (typically its From/To/Cc addresses) at seen, evicting the
+// least-recently-observed thread if we're over capacity, and returns the
+// thread's updated summary.
+func (t *threadTracker) observe(id string, participants []string, seen time.Time) threadSummary {
+	var entry *threadEntry
+	if el, ok := t.index[id]; ok {
+		entry = el.Value.(*threadEntry)
+		t.order.MoveToFront(el)
+	} else {
+		entry = &threadEntry{id: id, participants: make(map[string]struct{}), firstSeen: seen}
+		t.index[id] = t.order.PushFront(entry)
+	}
+
+	entry.messageCount++
+	entry.lastSeen = seen
+	for _, p := range participants {
+		if p != "" {
+			entry.participants[p] = struct{}{}
+		}
+	}
+
+	for t.order.Len() > t.max {
+		oldest := t.order.Back()
+		if oldest == nil {
+			break
+		}
+
+		old := t.order.Remove(oldest).(*threadEntry)
+		delete(t.index, old.id)
+	}
+
+	return entry.summary()
 }
 
 // NewFromEmail is a simple factory for streamtools to make new blocks of this kind.
 // By default, the block is configured for GMail.
 func NewFromEmail() blocks.BlockInterface {
-	return &FromEmail{host: "imap.gmail.com", mailbox: "INBOX"}
+	return &FromEmail{host: "imap.gmail.com", mailbox: "INBOX", authMethod: "plain"}
 }
 
-func newIMAPClient(host, username, password, mailbox string) (*imap.Client, error) {
-	conn, err := imap.DialTLS(host, new(tls.Config))
+func newIMAPClient(host, username, password, mailbox, authMethod, clientID, clientSecret, tokenURL, refreshToken string, readOnly bool) (*client.Client, error) {
+	conn, err := client.DialTLS(host, new(tls.Config))
 	if err != nil {
 		return conn, err
 	}
 
-	_, err = conn.Login(username, password)
-	if err != nil {
-		return conn, err
+	switch authMethod {
+	case "xoauth2":
+		token, err := fetchOAuthToken(clientID, clientSecret, tokenURL, refreshToken)
+		if err != nil {
+			return conn, err
+		}
+
+		err = conn.Authenticate(newXOAuth2Client(username, token))
+		if err != nil {
+			return conn, err
+		}
+	default:
+		err = conn.Login(username, password)
+		if err != nil {
+			return conn, err
+		}
 	}
 
-	_, err = imap.Wait(conn.Select(mailbox, true))
+	_, err = conn.Select(mailbox, readOnly)
 	if err != nil {
 		return conn, err
 	}
@@ -58,141 +257,502 @@ func newIMAPClient(host, username, password, mailbox string) (*imap.Client, erro
 	return conn, nil
 }
 
-func (e *FromEmail) idle() {
-	var err error
-	_, err = e.client.Idle()
+// connect dials a fresh IMAP client using the block's current credentials
+// and installs it as e.client, replacing whatever was there before. The
+// mailbox is selected read-write when markSeen is set, since flagging a
+// message \Seen requires a STORE, which a read-only (EXAMINE'd) mailbox
+// rejects.
+func (e *FromEmail) connect() error {
+	c, err := newIMAPClient(e.host, e.username, e.password, e.mailbox, e.authMethod, e.clientID, e.clientSecret, e.tokenURL, e.refreshToken, !e.markSeen)
+	if err != nil {
+		return err
+	}
+
+	e.clientMu.Lock()
+	e.client = c
+	e.clientMu.Unlock()
+
+	return nil
+}
+
+// getClient returns the block's current IMAP client, safe to call from the
+// idler goroutine while Run may be swapping it out.
+func (e *FromEmail) getClient() *client.Client {
+	e.clientMu.Lock()
+	defer e.clientMu.Unlock()
+	return e.client
+}
+
+// closeClient logs out the current IMAP client, if any.
+func (e *FromEmail) closeClient() {
+	e.clientMu.Lock()
+	c := e.client
+	e.client = nil
+	e.clientMu.Unlock()
+
+	if c != nil {
+		c.Logout()
+	}
+}
+
+// fetchOAuthToken exchanges the stored refresh token for a short-lived
+// access token against the provider's OAuth2 token endpoint.
+func fetchOAuthToken(clientID, clientSecret, tokenURL, refreshToken string) (string, error) {
+	conf := &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Endpoint:     oauth2.Endpoint{TokenURL: tokenURL},
+	}
+
+	src := conf.TokenSource(context.Background(), &oauth2.Token{RefreshToken: refreshToken})
+	token, err := src.Token()
 	if err != nil {
-		e.Error(err.Error())
-		return
+		return "", err
 	}
 
-	// kicks off occasional Data check during Idle
-	poll := make(chan uint)
-	poll <- 0
+	return token.AccessToken, nil
+}
+
+// xoauth2Client is a sasl.Client implementing the XOAUTH2 mechanism used by
+// Gmail and Office365 in place of a plain password.
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func newXOAuth2Client(username, token string) sasl.Client {
+	return &xoauth2Client{username: username, token: token}
+}
+
+func (c *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	resp := fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", c.username, c.token)
+	return "XOAUTH2", []byte(resp), nil
+}
+
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return nil, fmt.Errorf("xoauth2: unexpected server challenge: %s", challenge)
+}
+
+const (
+	// idleResetInterval caps how long a single IDLE command runs before we
+	// reissue it, per RFC-2177's recommendation to reset at least every 29
+	// minutes.
+	idleResetInterval = 25 * time.Minute
+
+	// idleWatchdog forces a reconnect if the server goes quiet for this
+	// long, since some IMAP servers (and NATs) silently drop IDLE
+	// connections without closing the socket.
+	idleWatchdog = 2 * idleResetInterval
+
+	// maxBackoff caps the exponential backoff used to retry a dropped
+	// connection.
+	maxBackoff = 5 * time.Minute
+)
+
+// errIdlerStopped signals that idleOnce returned because stop was closed,
+// as opposed to a connection error that should trigger a reconnect.
+var errIdlerStopped = fmt.Errorf("idler: stopped")
+
+// idler runs the IMAP IDLE loop for a FromEmail block on its own goroutine:
+// wait for new mail, fetch it, and reconnect with exponential backoff
+// whenever the connection drops. It is stopped by closing stop and waited
+// on via done.
+type idler struct {
+	e    *FromEmail
+	stop chan struct{}
+	done chan error
+}
+
+func newIdler(e *FromEmail) *idler {
+	return &idler{e: e, stop: make(chan struct{}), done: make(chan error, 1)}
+}
 
-	// setup ticker to reset the idle every 20 minutes (RFC-2177 recommends every <=29 mins)
-	reset := time.NewTicker(20 * time.Minute)
+func (i *idler) run() {
+	i.done <- i.loop()
+}
 
+func (i *idler) loop() error {
+	backoff := time.Second
 	for {
-		err = nil
+		err := i.idleOnce()
+		switch err {
+		case nil:
+			backoff = time.Second
+			continue
+		case errIdlerStopped:
+			return nil
+		}
+
+		i.e.Error(err.Error())
+
 		select {
-		case <-poll:
-			// check pipe for new data
-			err = e.client.Recv(0)
-			if err != nil {
-				e.Error(err.Error())
-				sleep(poll)
-				return
-			}
+		case <-i.stop:
+			return nil
+		case <-time.After(backoff):
+		}
 
-			if len(e.client.Data) > 0 {
-				// term idle and fetch unread
-				_, err = e.client.IdleTerm()
-				if err != nil {
-					e.Error(err.Error())
-					sleep(poll)
-					return
-				}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
 
-				// put any new unread messages on the channel
-				err = e.fetchUnread()
-				if err != nil {
-					e.Error(err.Error())
-					sleep(poll)
-					return
-				}
+		if err := i.e.connect(); err != nil {
+			i.e.Error(err.Error())
+		}
+	}
+}
 
-				// kick off that idle again
-				_, err = e.client.Idle()
-				if err != nil {
-					e.Error(err.Error())
-					sleep(poll)
-					return
-				}
+// idleOnce runs a single IMAP IDLE command via go-imap-idle, returning when
+// new mail arrives (after fetching it), the connection errors, the idle
+// watchdog trips, or stop is closed.
+func (i *idler) idleOnce() error {
+	c := i.e.getClient()
+	if c == nil {
+		return fmt.Errorf("idler: no IMAP connection")
+	}
+
+	updates := make(chan client.Update, 8)
+	c.Updates = updates
+
+	idleStop := make(chan struct{})
+	idleDone := make(chan error, 1)
+	go func() {
+		idleDone <- idle.NewClient(c).IdleWithFallback(idleStop, idleResetInterval)
+	}()
+
+	watchdog := time.NewTimer(idleWatchdog)
+	defer watchdog.Stop()
+
+	// IdleWithFallback silently re-issues IDLE every idleResetInterval to
+	// stay under the RFC 2177 cap; that internal refresh never surfaces as
+	// a client.Update, so on a healthy but quiet mailbox updates never
+	// fires either. Use the same cadence to tell "mailbox quiet" from
+	// "connection dead": reaching a tick without idleDone having fired
+	// means the last refresh cycle completed, so push the watchdog back
+	// out instead of letting it trip on mere silence.
+	refreshed := time.NewTicker(idleResetInterval)
+	defer refreshed.Stop()
+
+	stopIdle := func() error {
+		close(idleStop)
+		return <-idleDone
+	}
+
+	for {
+		select {
+		case <-i.stop:
+			stopIdle()
+			return errIdlerStopped
+
+		case upd := <-updates:
+			if _, ok := upd.(*client.MailboxUpdate); !ok {
+				continue
 			}
-			// sleep a bit before checking the pipe again
-			sleep(poll)
 
-		case <-reset.C:
-			_, err = e.client.IdleTerm()
-			if err != nil {
-				e.Error(err.Error())
-				return
+			if err := stopIdle(); err != nil {
+				return err
 			}
 
-			_, err = e.client.Idle()
-			if err != nil {
-				e.Error(err.Error())
-				return
+			// UidFetch can itself provoke further unsolicited server updates
+			// (EXISTS, EXPUNGE, recent-flag changes); with nobody left
+			// reading updates, the client's reader goroutine would block
+			// once it filled up and wedge the fetch. Detach it for the
+			// duration of the fetch.
+			c.Updates = nil
+			return i.e.fetchUnread()
+
+		case err := <-idleDone:
+			return err
+
+		case <-refreshed.C:
+			if !watchdog.Stop() {
+				<-watchdog.C
 			}
+			watchdog.Reset(idleWatchdog)
+
+		case <-watchdog.C:
+			stopIdle()
+			return fmt.Errorf("idler: no server activity for %s, reconnecting", idleWatchdog)
 		}
 	}
 }
 
-func sleep(poll chan uint) {
-	go func() {
-		time.Sleep(10 * time.Second)
-		poll <- 1
-	}()
-}
-
 func (e *FromEmail) fetchUnread() error {
-	cmd, err := findUnreadEmails(e.client)
+	c := e.getClient()
+
+	uids, err := uidSearch(c, e.searchFields)
 	if err != nil {
 		return err
 	}
 
-	var emails []emailMessage
-	emails, err = getEmails(e.client, cmd)
+	fetched, err := getEmails(c, uids, e.includeAttachments, e.threadMode == "gmail")
 	if err != nil {
 		return err
 	}
 
-	for _, email := range emails {
-		var emailStr []byte
-		emailStr, err = json.Marshal(email)
+	for _, f := range fetched {
+		emailStr, err := json.Marshal(f.email)
 		if err != nil {
 			e.Error(err.Error())
 			continue
 		}
 		e.out <- emailStr
+
+		if e.threadMode == "gmail" && f.threadID != "" && e.threads != nil {
+			participants := append([]string{f.email.From}, f.email.To...)
+			participants = append(participants, f.email.Cc...)
+			summary := e.threads.observe(f.threadID, participants, f.email.Received)
+
+			if e.emitThreadSummaries {
+				event := threadSummaryEvent{
+					Event:        "thread-summary",
+					ThreadID:     summary.ThreadID,
+					MessageCount: summary.MessageCount,
+					Participants: summary.Participants,
+					FirstSeen:    summary.FirstSeen,
+					LastSeen:     summary.LastSeen,
+				}
+
+				eventStr, err := json.Marshal(event)
+				if err != nil {
+					e.Error(err.Error())
+				} else {
+					e.out <- eventStr
+				}
+			}
+		}
+
+		if e.markSeen {
+			if err := markSeen(c, f.uid); err != nil {
+				e.Error(err.Error())
+			}
+		}
 	}
 
 	return nil
 }
 
-func getEmails(client *imap.Client, cmd *imap.Command) ([]emailMessage, error) {
-	var emails []emailMessage
+// parseSearchFilter turns a raw IMAP SEARCH criteria string into the
+// imap.Fields the protocol layer expects, defaulting to "UNSEEN" so an empty
+// filter doesn't re-fetch the whole mailbox on every poll. Tokens are split
+// on whitespace, except inside double quotes, so criteria like
+// `FROM "John Doe"` keep the quoted phrase as a single field; the
+// surrounding quotes are stripped since imap.Field values are sent as IMAP
+// literals/quoted-strings by the client, not passed through verbatim.
+func parseSearchFilter(filter string) []imap.Field {
+	filter = strings.TrimSpace(filter)
+	if filter == "" {
+		filter = "UNSEEN"
+	}
+
+	var fields []imap.Field
+	var tok strings.Builder
+	inQuotes := false
+
+	flush := func() {
+		if tok.Len() > 0 {
+			fields = append(fields, tok.String())
+			tok.Reset()
+		}
+	}
+
+	for _, r := range filter {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && (r == ' ' || r == '\t'):
+			flush()
+		default:
+			tok.WriteRune(r)
+		}
+	}
+	flush()
+
+	return fields
+}
 
-	seq, _ := imap.NewSeqSet("")
-	for _, rsp := range cmd.Data {
-		uid := rsp.MessageInfo().UID
-		seq.AddNum(uid)
+// uidSearch issues a raw UID SEARCH using pre-parsed criteria fields, since
+// free-form IMAP SEARCH criteria don't map cleanly onto the client's
+// structured SearchCriteria type.
+func uidSearch(c *client.Client, fields []imap.Field) ([]uint32, error) {
+	cmd := &imap.Command{
+		Name:      "UID SEARCH",
+		Arguments: fields,
 	}
 
-	fCmd, err := imap.Wait(client.UIDFetch(seq, "INTERNALDATE", "BODY[]", "UID", "RFC822.HEADER"))
+	res := &responses.Search{}
+	status, err := c.Execute(cmd, res)
 	if err != nil {
-		return emails, err
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+
+	return res.Ids, nil
+}
+
+// markSeen flags uid \Seen so fetchUnread doesn't re-emit it on the next poll.
+func markSeen(c *client.Client, uid uint32) error {
+	seq := new(imap.SeqSet)
+	seq.AddNum(uid)
+
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	return c.UidStore(seq, item, []interface{}{imap.SeenFlag}, nil)
+}
+
+// gmailThridItem and gmailMsgidItem are Gmail's IMAP extension attributes
+// for grouping messages into threads; they aren't part of the base IMAP
+// spec, so they're not exposed as named constants in the client library.
+const (
+	gmailThridItem = imap.FetchItem("X-GM-THRID")
+	gmailMsgidItem = imap.FetchItem("X-GM-MSGID")
+)
+
+func getEmails(c *client.Client, uids []uint32, includeAttachments, gmailThreads bool) ([]fetchedMessage, error) {
+	var fetched []fetchedMessage
+	if len(uids) == 0 {
+		return fetched, nil
+	}
+
+	seq := new(imap.SeqSet)
+	seq.AddNum(uids...)
+
+	section := &imap.BodySectionName{}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate, section.FetchItem()}
+	if gmailThreads {
+		items = append(items, gmailThridItem, gmailMsgidItem)
+	}
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seq, items, messages)
+	}()
+
+	for msg := range messages {
+		body := msg.GetBody(section)
+		if body == nil {
+			continue
+		}
+
+		raw, err := ioutil.ReadAll(body)
+		if err != nil {
+			return fetched, err
+		}
+
+		email, err := parseEmail(raw, includeAttachments)
+		if err != nil {
+			return fetched, err
+		}
+		email.Received = msg.InternalDate
+
+		var threadID string
+		if gmailThreads {
+			if thrid, ok := gmailThreadID(msg); ok {
+				threadID = strconv.FormatUint(thrid, 10)
+				email.ThreadID = threadID
+			}
+		}
+
+		fetched = append(fetched, fetchedMessage{uid: msg.Uid, threadID: threadID, email: email})
+	}
+
+	if err := <-done; err != nil {
+		return fetched, err
+	}
+
+	return fetched, nil
+}
+
+// gmailThreadID pulls the X-GM-THRID attribute off a fetched message, if the
+// server returned one.
+func gmailThreadID(msg *imap.Message) (uint64, bool) {
+	raw, ok := msg.Items[gmailThridItem]
+	if !ok || raw == nil {
+		return 0, false
 	}
 
-	for _, msgData := range fCmd.Data {
-		msgFields := msgData.MessageInfo().Attrs
-		email := emailMessage{Received: imap.AsDateTime(msgFields["INTERNALDATE"]), Body: imap.AsString(msgFields["BODY[]"])}
-		emails = append(emails, email)
+	switch v := raw.(type) {
+	case uint64:
+		return v, true
+	case uint32:
+		return uint64(v), true
+	case string:
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return n, true
+	default:
+		return 0, false
 	}
-	return emails, nil
 }
 
-func findUnreadEmails(conn *imap.Client) (*imap.Command, error) {
-	// get headers and UID for UnSeen message in src inbox...
-	allMsgs, _ := imap.NewSeqSet("")
-	allMsgs.Add("1:*")
-	cmd, err := imap.Wait(conn.Fetch(allMsgs, "RFC822.HEADER", "UID"))
+// parseEmail runs a raw RFC822 message through a MIME parser and flattens it
+// into the fields we emit downstream. Attachment content is only decoded
+// when includeAttachments is set, since it can be large.
+func parseEmail(raw []byte, includeAttachments bool) (emailMessage, error) {
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
 	if err != nil {
-		return &imap.Command{}, err
+		return emailMessage{}, err
+	}
+
+	email := emailMessage{
+		From:       fromAddress(env),
+		To:         addressList(env, "To"),
+		Cc:         addressList(env, "Cc"),
+		Subject:    env.GetHeader("Subject"),
+		MessageID:  env.GetHeader("Message-Id"),
+		InReplyTo:  env.GetHeader("In-Reply-To"),
+		References: strings.Fields(env.GetHeader("References")),
+		TextBody:   env.Text,
+		HTMLBody:   env.HTML,
+	}
+
+	if date, err := env.Date(); err == nil {
+		email.Date = date
 	}
 
-	return cmd, nil
+	if includeAttachments {
+		for _, a := range env.Attachments {
+			email.Attachments = append(email.Attachments, attachment{
+				Filename:    a.FileName,
+				ContentType: a.ContentType,
+				Size:        len(a.Content),
+				Content:     base64.StdEncoding.EncodeToString(a.Content),
+			})
+		}
+	}
+
+	return email, nil
+}
+
+// fromAddress pulls the bare address out of the From header, matching the
+// normalization addressList applies to To/Cc, so the same sender is never
+// counted twice (once as "Name" <addr>, once as addr) when From/To/Cc are
+// merged into a thread's participants. Falls back to the raw header if it
+// can't be parsed as an address.
+func fromAddress(env *enmime.Envelope) string {
+	if addrs := addressList(env, "From"); len(addrs) > 0 {
+		return addrs[0]
+	}
+	return env.GetHeader("From")
+}
+
+// addressList pulls a header's address list out of env as plain email
+// address strings, returning nil if the header is absent or unparseable.
+func addressList(env *enmime.Envelope, header string) []string {
+	addrs, err := env.AddressList(header)
+	if err != nil || len(addrs) == 0 {
+		return nil
+	}
+
+	out := make([]string, len(addrs))
+	for i, a := range addrs {
+		out[i] = a.Address
+	}
+	return out
 }
 
 // Setup is called once before running the block. We build up the channels and specify what kind of block this is.
@@ -218,19 +778,114 @@ func (e *FromEmail) parseAuthRules(msgI interface{}) error {
 		return err
 	}
 
-	e.password, err = util.ParseRequiredString(msgI, "Password")
+	e.mailbox, err = util.ParseRequiredString(msgI, "Mailbox")
+	if err != nil {
+		return err
+	}
+
+	e.authMethod, err = util.ParseString(msgI, "AuthMethod", "plain")
+	if err != nil {
+		return err
+	}
+
+	switch e.authMethod {
+	case "plain":
+		e.password, err = util.ParseRequiredString(msgI, "Password")
+		if err != nil {
+			return err
+		}
+	case "xoauth2":
+		e.clientID, err = util.ParseRequiredString(msgI, "ClientID")
+		if err != nil {
+			return err
+		}
+
+		e.clientSecret, err = util.ParseRequiredString(msgI, "ClientSecret")
+		if err != nil {
+			return err
+		}
+
+		e.tokenURL, err = util.ParseRequiredString(msgI, "TokenURL")
+		if err != nil {
+			return err
+		}
+
+		e.refreshToken, err = util.ParseRequiredString(msgI, "RefreshToken")
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown AuthMethod %q, expected \"plain\" or \"xoauth2\"", e.authMethod)
+	}
+
+	e.includeAttachments, err = util.ParseBool(msgI, "IncludeAttachments", false)
+	if err != nil {
+		return err
+	}
+
+	e.searchFilter, err = util.ParseString(msgI, "SearchFilter", "")
 	if err != nil {
 		return err
 	}
+	e.searchFields = parseSearchFilter(e.searchFilter)
 
-	e.password, err = util.ParseRequiredString(msgI, "Mailbox")
+	e.markSeen, err = util.ParseBool(msgI, "MarkSeen", true)
 	if err != nil {
 		return err
 	}
 
+	e.threadMode, err = util.ParseString(msgI, "ThreadMode", "none")
+	if err != nil {
+		return err
+	}
+	if e.threadMode != "none" && e.threadMode != "gmail" {
+		return fmt.Errorf("unknown ThreadMode %q, expected \"none\" or \"gmail\"", e.threadMode)
+	}
+
+	e.emitThreadSummaries, err = util.ParseBool(msgI, "EmitThreadSummaries", false)
+	if err != nil {
+		return err
+	}
+
+	e.maxThreads, err = parseIntField(msgI, "MaxThreads", 10000)
+	if err != nil {
+		return err
+	}
+
+	if e.threadMode == "gmail" && (e.threads == nil || e.threads.max != e.maxThreads) {
+		e.threads = newThreadTracker(e.maxThreads)
+	}
+
 	return nil
 }
 
+// parseIntField reads an integer rule field, which arrives as a JSON number
+// once decoded, falling back to def when it's absent.
+func parseIntField(msgI interface{}, key string, def int) (int, error) {
+	msg, ok := msgI.(map[string]interface{})
+	if !ok {
+		return def, nil
+	}
+
+	v, ok := msg[key]
+	if !ok {
+		return def, nil
+	}
+
+	switch n := v.(type) {
+	case float64:
+		return int(n), nil
+	case string:
+		parsed, err := strconv.Atoi(n)
+		if err != nil {
+			return 0, fmt.Errorf("%s must be a number: %s", key, err.Error())
+		}
+		return parsed, nil
+	default:
+		return 0, fmt.Errorf("%s must be a number", key)
+	}
+}
+
 // Run is the block's main loop. Here we listen on the different channels we set up.
 func (e *FromEmail) Run() {
 	var err error
@@ -245,13 +900,28 @@ func (e *FromEmail) Run() {
 				continue
 			}
 
+			// stop any previously running idler before reconnecting with the
+			// new rule's credentials
+			if e.idler != nil {
+				close(e.idler.stop)
+				<-e.idler.done
+				e.idler = nil
+			}
+			e.closeClient()
+
 			// initiate IMAP client with new creds
-			e.client, err = newIMAPClient(e.host, e.username, e.password, e.mailbox)
+			err = e.connect()
 			if err != nil {
 				e.Error(err.Error())
 				continue
 			}
-			defer e.client.Close(true)
+
+			// validate the search filter against the live connection now, so
+			// a typo surfaces here instead of silently wedging the IDLE loop
+			if _, err = uidSearch(e.getClient(), e.searchFields); err != nil {
+				e.Error(fmt.Sprintf("invalid SearchFilter: %s", err.Error()))
+				continue
+			}
 
 			// do initial initial fetch on all existing unread messages
 			err = e.fetchUnread()
@@ -260,20 +930,46 @@ func (e *FromEmail) Run() {
 				continue
 			}
 
-			// kick off idle in a goroutine
-			go e.idle()
+			// kick off the IDLE loop in a goroutine
+			e.idler = newIdler(e)
+			go e.idler.run()
 
 		case <-e.quit:
-			e.client.Close(true)
+			if e.idler != nil {
+				close(e.idler.stop)
+				<-e.idler.done
+			}
+			e.closeClient()
 			return
 		case respChan := <-e.queryrule:
 			// deal with a query request
-			respChan <- map[string]interface{}{
-				"Host":     e.host,
-				"Username": e.username,
-				"Password": e.password,
-				"Mailbox":  e.mailbox,
+			resp := map[string]interface{}{
+				"Host":                e.host,
+				"Username":            e.username,
+				"Mailbox":             e.mailbox,
+				"AuthMethod":          e.authMethod,
+				"IncludeAttachments":  e.includeAttachments,
+				"SearchFilter":        e.searchFilter,
+				"MarkSeen":            e.markSeen,
+				"ThreadMode":          e.threadMode,
+				"EmitThreadSummaries": e.emitThreadSummaries,
+				"MaxThreads":          e.maxThreads,
 			}
+
+			// Password only makes sense for plain auth; xoauth2 is configured
+			// via the ClientID/TokenURL family instead, so don't echo the
+			// unused Password field and do surface what's actually in play.
+			switch e.authMethod {
+			case "xoauth2":
+				resp["ClientID"] = e.clientID
+				resp["ClientSecret"] = e.clientSecret
+				resp["TokenURL"] = e.tokenURL
+				resp["RefreshToken"] = e.refreshToken
+			default:
+				resp["Password"] = e.password
+			}
+
+			respChan <- resp
 		}
 	}
 }
@@ -0,0 +1,548 @@
+package library
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// ToEmail holds channels we're going to use to communicate with streamtools,
+// credentials for an SMTP server and a pooled connection to it. It is the
+// sink counterpart to FromEmail: sending an outbound message in response to
+// whatever triggered the rule.
+type ToEmail struct {
+	blocks.Block
+	queryrule chan chan interface{}
+	inrule    chan interface{}
+	in        chan interface{}
+	quit      chan interface{}
+
+	host        string
+	port        int
+	username    string
+	password    string
+	from        string
+	useTLS      bool
+	useSTARTTLS bool
+
+	client *smtp.Client
+}
+
+// outboundAttachment is a single file to attach to an outbound message.
+type outboundAttachment struct {
+	Filename      string
+	ContentType   string
+	ContentBase64 string
+}
+
+// outboundMessage is what we expect to find on the "in" channel: enough to
+// build a MIME message and hand it to the SMTP server.
+type outboundMessage struct {
+	To          []string
+	Subject     string
+	TextBody    string
+	HTMLBody    string
+	Attachments []outboundAttachment
+}
+
+// NewToEmail is a simple factory for streamtools to make new blocks of this kind.
+func NewToEmail() blocks.BlockInterface {
+	return &ToEmail{port: 587, useSTARTTLS: true}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (e *ToEmail) Setup() {
+	e.Kind = "ToEmail"
+	e.in = e.InRoute("in")
+	e.inrule = e.InRoute("rule")
+	e.queryrule = e.QueryRoute("rule")
+	e.quit = e.Quit()
+}
+
+// parseAuthRules pulls the SMTP connection details out of a rule payload.
+func (e *ToEmail) parseAuthRules(msgI interface{}) error {
+	var err error
+	e.host, err = util.ParseRequiredString(msgI, "Host")
+	if err != nil {
+		return err
+	}
+
+	e.port, err = parsePort(msgI, e.port)
+	if err != nil {
+		return err
+	}
+
+	e.username, err = util.ParseRequiredString(msgI, "Username")
+	if err != nil {
+		return err
+	}
+
+	e.password, err = util.ParseRequiredString(msgI, "Password")
+	if err != nil {
+		return err
+	}
+
+	e.from, err = util.ParseRequiredString(msgI, "From")
+	if err != nil {
+		return err
+	}
+
+	e.useTLS, err = util.ParseBool(msgI, "UseTLS", false)
+	if err != nil {
+		return err
+	}
+
+	e.useSTARTTLS, err = util.ParseBool(msgI, "UseSTARTTLS", true)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// parsePort reads the Port rule field, which arrives as a JSON number once
+// decoded, falling back to def when it's absent.
+func parsePort(msgI interface{}, def int) (int, error) {
+	msg, ok := msgI.(map[string]interface{})
+	if !ok {
+		return def, nil
+	}
+
+	v, ok := msg["Port"]
+	if !ok {
+		return def, nil
+	}
+
+	switch p := v.(type) {
+	case float64:
+		return int(p), nil
+	case string:
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, fmt.Errorf("Port must be a number: %s", err.Error())
+		}
+		return n, nil
+	default:
+		return 0, fmt.Errorf("Port must be a number")
+	}
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (e *ToEmail) Run() {
+	var err error
+	for {
+		err = nil
+		select {
+		case msgI := <-e.inrule:
+			err = e.parseAuthRules(msgI)
+			if err != nil {
+				e.Error(err.Error())
+				continue
+			}
+
+			// credentials changed, so drop the pooled connection and redial
+			// lazily on the next outbound message
+			if e.client != nil {
+				e.client.Close()
+				e.client = nil
+			}
+
+		case msgI := <-e.in:
+			err = e.send(msgI)
+			if err != nil {
+				e.Error(err.Error())
+			}
+
+		case <-e.quit:
+			if e.client != nil {
+				e.client.Close()
+			}
+			return
+		case respChan := <-e.queryrule:
+			respChan <- map[string]interface{}{
+				"Host":        e.host,
+				"Port":        e.port,
+				"Username":    e.username,
+				"Password":    e.password,
+				"From":        e.from,
+				"UseTLS":      e.useTLS,
+				"UseSTARTTLS": e.useSTARTTLS,
+			}
+		}
+	}
+}
+
+// send builds a MIME message from msgI and delivers it over the pooled SMTP
+// connection, dialing one if none exists yet and redialing once if delivery
+// fails because the pooled connection has gone stale.
+func (e *ToEmail) send(msgI interface{}) error {
+	msg, err := parseOutboundMessage(msgI)
+	if err != nil {
+		return err
+	}
+
+	raw, err := buildMIMEMessage(e.from, msg)
+	if err != nil {
+		return err
+	}
+
+	if e.client == nil {
+		e.client, err = e.dial()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = deliver(e.client, e.from, msg.To, raw)
+	if err == nil || !isConnError(err) {
+		return err
+	}
+
+	e.client.Close()
+	e.client, err = e.dial()
+	if err != nil {
+		return err
+	}
+
+	return deliver(e.client, e.from, msg.To, raw)
+}
+
+// dial opens a fresh, authenticated connection to the SMTP server.
+func (e *ToEmail) dial() (*smtp.Client, error) {
+	addr := net.JoinHostPort(e.host, strconv.Itoa(e.port))
+
+	var conn net.Conn
+	var err error
+	if e.useTLS {
+		conn, err = tls.Dial("tcp", addr, &tls.Config{ServerName: e.host})
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 10*time.Second)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(conn, e.host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if !e.useTLS && e.useSTARTTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: e.host}); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if e.username != "" {
+		auth := smtp.PlainAuth("", e.username, e.password, e.host)
+		if err := c.Auth(auth); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// isConnError reports whether err looks like the underlying connection went
+// away, rather than an SMTP-level rejection worth surfacing as-is.
+func isConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, io.EOF) {
+		return true
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return false
+}
+
+// deliver runs a single SMTP transaction over an already-connected client.
+func deliver(c *smtp.Client, from string, to []string, raw []byte) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := wc.Write(raw); err != nil {
+		wc.Close()
+		return err
+	}
+
+	return wc.Close()
+}
+
+// parseOutboundMessage pulls the pieces of an outbound email out of an
+// inbound payload.
+func parseOutboundMessage(msgI interface{}) (*outboundMessage, error) {
+	var err error
+	msg := &outboundMessage{}
+
+	msg.To, err = parseRecipients(msgI)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Subject, err = util.ParseString(msgI, "Subject", "")
+	if err != nil {
+		return nil, err
+	}
+
+	msg.TextBody, err = util.ParseString(msgI, "TextBody", "")
+	if err != nil {
+		return nil, err
+	}
+
+	msg.HTMLBody, err = util.ParseString(msgI, "HTMLBody", "")
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Attachments, err = parseOutboundAttachments(msgI)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// parseRecipients pulls the "To" field out of an inbound payload, accepting
+// either a single address or a list of addresses.
+func parseRecipients(msgI interface{}) ([]string, error) {
+	msg, ok := msgI.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("could not parse message")
+	}
+
+	switch v := msg["To"].(type) {
+	case string:
+		if v == "" {
+			return nil, fmt.Errorf("To is required")
+		}
+		return []string{v}, nil
+	case []interface{}:
+		var to []string
+		for _, r := range v {
+			addr, ok := r.(string)
+			if !ok {
+				return nil, fmt.Errorf("To must be a string or a list of strings")
+			}
+			to = append(to, addr)
+		}
+		if len(to) == 0 {
+			return nil, fmt.Errorf("To is required")
+		}
+		return to, nil
+	default:
+		return nil, fmt.Errorf("To is required")
+	}
+}
+
+// parseOutboundAttachments pulls the optional "Attachments" list out of an
+// inbound payload, returning nil if it's absent.
+func parseOutboundAttachments(msgI interface{}) ([]outboundAttachment, error) {
+	msg, ok := msgI.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	raw, ok := msg["Attachments"].([]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	var attachments []outboundAttachment
+	for _, a := range raw {
+		fields, ok := a.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("each attachment must be an object")
+		}
+
+		filename, err := util.ParseRequiredString(fields, "Filename")
+		if err != nil {
+			return nil, err
+		}
+
+		contentType, err := util.ParseString(fields, "ContentType", "application/octet-stream")
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := util.ParseRequiredString(fields, "ContentBase64")
+		if err != nil {
+			return nil, err
+		}
+
+		attachments = append(attachments, outboundAttachment{
+			Filename:      filename,
+			ContentType:   contentType,
+			ContentBase64: content,
+		})
+	}
+
+	return attachments, nil
+}
+
+// buildMIMEMessage assembles msg into a multipart MIME message ready to hand
+// to an SMTP server's DATA command.
+func buildMIMEMessage(from string, msg *outboundMessage) ([]byte, error) {
+	var buf bytes.Buffer
+
+	mixed := multipart.NewWriter(&buf)
+
+	buf.WriteString(fmt.Sprintf("From: %s\r\n", from))
+	buf.WriteString(fmt.Sprintf("To: %s\r\n", strings.Join(msg.To, ", ")))
+	buf.WriteString(fmt.Sprintf("Subject: %s\r\n", msg.Subject))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mixed.Boundary()))
+
+	// A multipart/alternative part with no sub-parts is malformed, so only
+	// build one if there's an actual body to carry.
+	if msg.TextBody != "" || msg.HTMLBody != "" {
+		altBuf := &bytes.Buffer{}
+		alt := multipart.NewWriter(altBuf)
+
+		if msg.TextBody != "" {
+			if err := writeTextPart(alt, "text/plain; charset=utf-8", msg.TextBody); err != nil {
+				return nil, err
+			}
+		}
+		if msg.HTMLBody != "" {
+			if err := writeTextPart(alt, "text/html; charset=utf-8", msg.HTMLBody); err != nil {
+				return nil, err
+			}
+		}
+		if err := alt.Close(); err != nil {
+			return nil, err
+		}
+
+		altHeader := textproto.MIMEHeader{}
+		altHeader.Set("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%s", alt.Boundary()))
+		altPart, err := mixed.CreatePart(altHeader)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := altPart.Write(altBuf.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, a := range msg.Attachments {
+		if err := writeAttachmentPart(mixed, a); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeTextPart(w *multipart.Writer, contentType, body string) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	qp := quotedprintable.NewWriter(part)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func writeAttachmentPart(w *multipart.Writer, a outboundAttachment) error {
+	content, err := base64.StdEncoding.DecodeString(a.ContentBase64)
+	if err != nil {
+		return fmt.Errorf("attachment %s: %s", a.Filename, err.Error())
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", a.ContentType)
+	header.Set("Content-Transfer-Encoding", "base64")
+	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", a.Filename))
+
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	enc := base64.NewEncoder(base64.StdEncoding, &base64LineWrapper{w: part})
+	if _, err := enc.Write(content); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// base64LineWrapper inserts a CRLF every 76 encoded characters, since RFC
+// 2045 caps base64 body lines at 76 chars and some MTAs reject longer
+// lines outright. It's meant to sit directly behind a base64.Encoder so
+// the encoded output is wrapped as it streams out, rather than building the
+// full line in memory first.
+type base64LineWrapper struct {
+	w       io.Writer
+	lineLen int
+}
+
+const base64LineLength = 76
+
+func (lw *base64LineWrapper) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := base64LineLength - lw.lineLen
+		if n > len(p) {
+			n = len(p)
+		}
+
+		if _, err := lw.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		lw.lineLen += n
+		p = p[n:]
+
+		if lw.lineLen == base64LineLength {
+			if _, err := lw.w.Write([]byte("\r\n")); err != nil {
+				return written, err
+			}
+			lw.lineLen = 0
+		}
+	}
+	return written, nil
+}